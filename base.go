@@ -1,6 +1,7 @@
 package ipproxy
 
 import (
+	"context"
 	"io"
 	"net"
 	"strings"
@@ -11,6 +12,7 @@ import (
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/link/channel"
 	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/network/ipv6"
 	"github.com/google/netstack/tcpip/stack"
 	"github.com/google/netstack/tcpip/transport/tcp"
 	"github.com/google/netstack/tcpip/transport/udp"
@@ -20,11 +22,25 @@ import (
 )
 
 const (
-	nicID            = 1
-	maxWriteWait     = 30 * time.Millisecond
-	tcpipHeaderBytes = 40
+	nicID        = 1
+	maxWriteWait = 30 * time.Millisecond
+
+	ipv4HeaderBytes = 20
+	ipv6HeaderBytes = 40
+	tcpHeaderBytes  = 20
 )
 
+// headerBytes returns the number of bytes to reserve for the IP and TCP
+// headers of a connection using the given network protocol, so that reads
+// from upstream leave enough room for the tcpip stack to prepend its own
+// headers without a reallocation.
+func headerBytes(proto tcpip.NetworkProtocolNumber) int {
+	if proto == ipv6.ProtocolNumber {
+		return ipv6HeaderBytes + tcpHeaderBytes
+	}
+	return ipv4HeaderBytes + tcpHeaderBytes
+}
+
 type baseConn struct {
 	lastActive int64
 	p          *proxy
@@ -34,6 +50,18 @@ type baseConn struct {
 	waitEntry  *waiter.Entry
 	notifyCh   chan struct{}
 
+	// proto is the network protocol (ipv4 or ipv6) of this connection's
+	// destination. It defaults to ipv4 sizing when left unset.
+	proto tcpip.NetworkProtocolNumber
+
+	// opened records when this connection was created, so that a ConnTracker
+	// can report its eventual lifetime.
+	opened time.Time
+
+	// limiterKey identifies this connection to the configured Limiter,
+	// derived from its destination via Opts.Classifier.
+	limiterKey string
+
 	closeable
 }
 
@@ -47,6 +75,7 @@ func newBaseConn(p *proxy, upstream io.ReadWriteCloser, wq *waiter.Queue, finali
 		wq:        wq,
 		waitEntry: &waitEntry,
 		notifyCh:  notifyCh,
+		opened:    time.Now(),
 		closeable: closeable{
 			closeCh:           make(chan struct{}),
 			readyToFinalizeCh: make(chan struct{}),
@@ -98,6 +127,24 @@ func (conn *baseConn) copyToUpstream(readAddr *tcpip.FullAddress) {
 			}
 			return
 		}
+		// Mark active before waiting on our rate limit so that a conn that's
+		// merely throttled, not idle, survives the idle-connection reaper.
+		conn.markActive()
+		// buf has already been read off the wire, so on a Limiter error we
+		// can't just skip it without corrupting the TCP stream; close the
+		// connection instead of silently dropping mid-stream bytes.
+		if err := conn.p.opts.Limiter.WaitConnPacket(context.Background(), conn.limiterKey); err != nil {
+			if err != context.Canceled {
+				log.Errorf("Rate limiter error, closing connection to %v: %v", conn.limiterKey, err)
+			}
+			return
+		}
+		if err := conn.p.opts.Limiter.WaitConnBytes(context.Background(), conn.limiterKey, len(buf)); err != nil {
+			if err != context.Canceled {
+				log.Errorf("Rate limiter error, closing connection to %v: %v", conn.limiterKey, err)
+			}
+			return
+		}
 		if _, writeErr := conn.upstream.Write(buf); writeErr != nil {
 			log.Errorf("Unexpected error writing to upstream: %v", writeErr)
 			return
@@ -117,18 +164,43 @@ func (conn *baseConn) copyFromUpstream(responseOptions tcpip.WriteOptions) {
 	defer conn.Close()
 
 	for {
-		// we can't reuse this byte slice across reads because each one is held in
-		// memory by the tcpip stack.
-		b := make([]byte, conn.p.opts.MTU-tcpipHeaderBytes) // leave room for tcpip header that gets added later
+		// Pooled rather than freshly allocated: by the time writeToDownstream
+		// returns, conn.ep.Write has copied b into the tcpip stack's own send
+		// buffer, so b is safe to reuse for the next read.
+		pooled := conn.p.upstreamBufPool.Get().([]byte)
+		b := pooled[:conn.p.opts.MTU-headerBytes(conn.proto)] // leave room for tcpip header that gets added later
 		n, readErr := conn.upstream.Read(b)
 		if readErr != nil {
+			conn.p.upstreamBufPool.Put(pooled)
 			if readErr != io.EOF && !strings.Contains(readErr.Error(), "use of closed network connection") {
 				log.Errorf("Unexpected error reading from upstream: %v", readErr)
 			}
 			return
 		}
 
+		// Mark active before waiting on our rate limit so that a conn that's
+		// merely throttled, not idle, survives the idle-connection reaper.
+		conn.markActive()
+		// b has already been read from upstream, so on a Limiter error we
+		// can't just skip it without corrupting the TCP stream; close the
+		// connection instead of silently dropping mid-stream bytes.
+		if err := conn.p.opts.Limiter.WaitConnPacket(context.Background(), conn.limiterKey); err != nil {
+			conn.p.upstreamBufPool.Put(pooled)
+			if err != context.Canceled {
+				log.Errorf("Rate limiter error, closing connection to %v: %v", conn.limiterKey, err)
+			}
+			return
+		}
+		if err := conn.p.opts.Limiter.WaitConnBytes(context.Background(), conn.limiterKey, n); err != nil {
+			conn.p.upstreamBufPool.Put(pooled)
+			if err != context.Canceled {
+				log.Errorf("Rate limiter error, closing connection to %v: %v", conn.limiterKey, err)
+			}
+			return
+		}
+
 		writeErr := conn.writeToDownstream(b[:n], responseOptions)
+		conn.p.upstreamBufPool.Put(pooled)
 		if writeErr != nil {
 			log.Errorf("Unexpected error writing to downstream: %v", writeErr)
 			return
@@ -138,9 +210,17 @@ func (conn *baseConn) copyFromUpstream(responseOptions tcpip.WriteOptions) {
 }
 
 func (conn *baseConn) writeToDownstream(b []byte, responseOptions tcpip.WriteOptions) *tcpip.Error {
-	// write in a loop since partial writes are a possibility
+	return writeToEndpoint(conn.ep, b, responseOptions)
+}
+
+// writeToEndpoint writes all of b to ep, retrying with backoff on
+// ErrWouldBlock since partial writes are a possibility. It's used both by
+// baseConn.writeToDownstream and by code that needs to write to a netstack
+// endpoint before a baseConn has been set up for it, e.g. an intercepted DNS
+// response.
+func writeToEndpoint(ep tcpip.Endpoint, b []byte, responseOptions tcpip.WriteOptions) *tcpip.Error {
 	for i := time.Duration(0); true; i++ {
-		n, _, writeErr := conn.ep.Write(tcpip.SlicePayload(b), responseOptions)
+		n, _, writeErr := ep.Write(tcpip.SlicePayload(b), responseOptions)
 		if writeErr != nil {
 			if writeErr == tcpip.ErrWouldBlock {
 				// back off and retry
@@ -174,13 +254,18 @@ func (conn *baseConn) timeSinceLastActive() time.Duration {
 
 func newOrigin(p *proxy, addr addr, upstream io.ReadWriteCloser, finalizer func(o *origin) error) *origin {
 	linkID, channelEndpoint := channel.New(p.opts.OutboundBufferDepth, uint32(p.opts.MTU), "")
-	s := stack.New([]string{ipv4.ProtocolName}, []string{tcp.ProtocolName, udp.ProtocolName}, stack.Options{})
+	networkProtocols := []string{ipv4.ProtocolName}
+	if p.opts.EnableIPv6 {
+		networkProtocols = append(networkProtocols, ipv6.ProtocolName)
+	}
+	s := stack.New(networkProtocols, []string{tcp.ProtocolName, udp.ProtocolName}, stack.Options{})
 
-	ipAddr := tcpip.Address(net.ParseIP(addr.ip).To4())
+	ipAddr, proto := networkProtocolForIP(net.ParseIP(addr.ip))
 
 	o := &origin{
 		addr:            addr,
 		ipAddr:          ipAddr,
+		proto:           proto,
 		stack:           s,
 		linkID:          linkID,
 		channelEndpoint: channelEndpoint,
@@ -194,6 +279,8 @@ func newOrigin(p *proxy, addr addr, upstream io.ReadWriteCloser, finalizer func(
 		channelEndpoint.Drain()
 		return
 	})
+	o.baseConn.proto = proto
+	o.baseConn.limiterKey = p.opts.Classifier(addr.String())
 
 	go o.copyToDownstream()
 	return o
@@ -203,6 +290,7 @@ type origin struct {
 	*baseConn
 	addr            addr
 	ipAddr          tcpip.Address
+	proto           tcpip.NetworkProtocolNumber
 	stack           *stack.Stack
 	linkID          tcpip.LinkEndpointID
 	channelEndpoint *channel.Endpoint
@@ -229,12 +317,12 @@ func (o *origin) init(transportProtocol tcpip.TransportProtocolNumber, bindAddr
 	if err := o.stack.CreateNIC(nicID, o.linkID); err != nil {
 		return errors.New("Unable to create TCP NIC: %v", err)
 	}
-	if aErr := o.stack.AddAddress(nicID, o.p.proto, o.ipAddr); aErr != nil {
+	if aErr := o.stack.AddAddress(nicID, o.proto, o.ipAddr); aErr != nil {
 		return errors.New("Unable to assign NIC IP address: %v", aErr)
 	}
 
 	var epErr *tcpip.Error
-	if o.ep, epErr = o.stack.NewEndpoint(transportProtocol, o.p.proto, o.wq); epErr != nil {
+	if o.ep, epErr = o.stack.NewEndpoint(transportProtocol, o.proto, o.wq); epErr != nil {
 		return errors.New("Unable to create endpoint: %v", epErr)
 	}
 
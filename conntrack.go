@@ -0,0 +1,45 @@
+package ipproxy
+
+import "time"
+
+// ConnTracker receives lifecycle events for packets and connections flowing
+// through the proxy. It lets callers add observability (metrics, packet
+// capture, etc.) without reaching into the core proxying logic. All methods
+// may be called concurrently from multiple goroutines and must not block.
+type ConnTracker interface {
+	// OnPacket is called for every packet read from downstream, accepted or
+	// not. raw is the full packet as read off the wire; implementations that
+	// retain it (e.g. a pcap writer) must copy it, since an accepted packet's
+	// backing array is handed on to the tcpip stack. ipProto is the IP
+	// protocol number (e.g. IPProtocolTCP), or 0 if the packet wasn't parsed.
+	// Deliberately not labeled by destination: some packets reaching here
+	// (malformed ones, IPv6 ones dropped because EnableIPv6 is false) never
+	// get far enough to have a destination parsed.
+	OnPacket(raw []byte, ipProto uint8, accepted bool)
+
+	// OnTCPOpen/OnTCPClose track individual proxied TCP connections, keyed
+	// by the destination (host:port) and the downstream client address.
+	OnTCPOpen(dest, client string)
+	OnTCPClose(dest, client string, lifetime time.Duration)
+
+	// OnUDPOpen/OnUDPClose track individual proxied UDP flows, keyed by the
+	// destination (host:port) and the downstream client address.
+	OnUDPOpen(dest, client string)
+	OnUDPClose(dest, client string, lifetime time.Duration)
+
+	// OnReap is called after an idle-connection sweep that reaped anything,
+	// with how many TCP and UDP flows (or, for a sweep with no open
+	// connections on a destination, destinations) were reaped. TCP and UDP
+	// sweeps report separately, so one of the two counts is always 0.
+	OnReap(tcpReaped, udpReaped int)
+}
+
+// noopConnTracker is the default ConnTracker; it does nothing.
+type noopConnTracker struct{}
+
+func (noopConnTracker) OnPacket(raw []byte, ipProto uint8, accepted bool)      {}
+func (noopConnTracker) OnTCPOpen(dest, client string)                          {}
+func (noopConnTracker) OnTCPClose(dest, client string, lifetime time.Duration) {}
+func (noopConnTracker) OnUDPOpen(dest, client string)                          {}
+func (noopConnTracker) OnUDPClose(dest, client string, lifetime time.Duration) {}
+func (noopConnTracker) OnReap(tcpReaped, udpReaped int)                        {}
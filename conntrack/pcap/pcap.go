@@ -0,0 +1,162 @@
+// Package pcap provides an ipproxy.ConnTracker that writes every packet the
+// proxy sees to a rotating set of pcap files, truncating packets longer than
+// a configured snap length, for later offline analysis in tools like
+// Wireshark or tcpdump.
+package pcap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+
+	"github.com/luntan365/ipproxy"
+)
+
+var log = golog.LoggerFor("ipproxy.conntrack.pcap")
+
+const (
+	magicMicroseconds = 0xa1b2c3d4
+	versionMajor      = 2
+	versionMinor      = 4
+
+	// DefaultSnapLen is the default maximum number of bytes of each packet
+	// to record; longer packets are truncated.
+	DefaultSnapLen = 256
+
+	// DefaultMaxFileBytes is the default size at which a pcap file is
+	// rotated and a new one started.
+	DefaultMaxFileBytes = 100 * 1024 * 1024
+
+	// linkTypeRaw is the pcap LINKTYPE_RAW value, appropriate since we
+	// capture bare IP packets with no link-layer framing.
+	linkTypeRaw = 101
+)
+
+// Writer is an ipproxy.ConnTracker that records every packet it sees (both
+// accepted and rejected) to a rotating sequence of pcap files named
+// "<prefix>-0000.pcap", "<prefix>-0001.pcap", and so on.
+type Writer struct {
+	dir          string
+	prefix       string
+	snapLen      int
+	maxFileBytes int64
+
+	mx       sync.Mutex
+	cur      *os.File
+	curBytes int64
+	curSeq   int
+}
+
+// New creates a Writer that rotates files under dir once they reach
+// maxFileBytes, truncating packets to snapLen bytes. If snapLen or
+// maxFileBytes are <= 0, DefaultSnapLen/DefaultMaxFileBytes are used.
+func New(dir, prefix string, snapLen int, maxFileBytes int64) (*Writer, error) {
+	if snapLen <= 0 {
+		snapLen = DefaultSnapLen
+	}
+	if maxFileBytes <= 0 {
+		maxFileBytes = DefaultMaxFileBytes
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.New("Unable to create pcap output directory %v: %v", dir, err)
+	}
+	w := &Writer{
+		dir:          dir,
+		prefix:       prefix,
+		snapLen:      snapLen,
+		maxFileBytes: maxFileBytes,
+	}
+	if err := w.rotate(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Writer) rotate() error {
+	if w.cur != nil {
+		w.cur.Close()
+	}
+	name := filepath.Join(w.dir, fmt.Sprintf("%v-%04d.pcap", w.prefix, w.curSeq))
+	w.curSeq++
+	f, err := os.Create(name)
+	if err != nil {
+		return errors.New("Unable to create pcap file %v: %v", name, err)
+	}
+	if err := writeGlobalHeader(f, w.snapLen); err != nil {
+		f.Close()
+		return err
+	}
+	w.cur = f
+	w.curBytes = 0
+	return nil
+}
+
+func writeGlobalHeader(f *os.File, snapLen int) error {
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:4], magicMicroseconds)
+	binary.LittleEndian.PutUint16(hdr[4:6], versionMajor)
+	binary.LittleEndian.PutUint16(hdr[6:8], versionMinor)
+	// thiszone, sigfigs left zero
+	binary.LittleEndian.PutUint32(hdr[16:20], uint32(snapLen))
+	binary.LittleEndian.PutUint32(hdr[20:24], linkTypeRaw)
+	_, err := f.Write(hdr)
+	if err != nil {
+		return errors.New("Unable to write pcap global header: %v", err)
+	}
+	return nil
+}
+
+// OnPacket implements ipproxy.ConnTracker by writing raw to the current pcap
+// file, truncated to the configured snap length.
+func (w *Writer) OnPacket(raw []byte, ipProto uint8, accepted bool) {
+	incl := len(raw)
+	if incl > w.snapLen {
+		incl = w.snapLen
+	}
+	rec := make([]byte, 16+incl)
+	now := time.Now()
+	binary.LittleEndian.PutUint32(rec[0:4], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:8], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:12], uint32(incl))
+	binary.LittleEndian.PutUint32(rec[12:16], uint32(len(raw)))
+	copy(rec[16:], raw[:incl])
+
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	if w.curBytes+int64(len(rec)) > w.maxFileBytes {
+		if err := w.rotate(); err != nil {
+			log.Errorf("Unable to rotate pcap file: %v", err)
+			return
+		}
+	}
+	n, err := w.cur.Write(rec)
+	if err != nil {
+		log.Errorf("Unable to write pcap record: %v", err)
+		return
+	}
+	w.curBytes += int64(n)
+}
+
+func (w *Writer) OnTCPOpen(dest, client string)                          {}
+func (w *Writer) OnTCPClose(dest, client string, lifetime time.Duration) {}
+func (w *Writer) OnUDPOpen(dest, client string)                          {}
+func (w *Writer) OnUDPClose(dest, client string, lifetime time.Duration) {}
+func (w *Writer) OnReap(tcpReaped, udpReaped int)                        {}
+
+// Close flushes and closes the current pcap file.
+func (w *Writer) Close() error {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	if w.cur == nil {
+		return nil
+	}
+	return w.cur.Close()
+}
+
+var _ ipproxy.ConnTracker = (*Writer)(nil)
@@ -0,0 +1,110 @@
+// Package prometheus provides an ipproxy.ConnTracker that exposes
+// protocol-level packet/byte counters, per-destination connection counts, and
+// connection lifetime histograms labeled by protocol (tcp or udp, not by
+// destination) as Prometheus metrics. Packet/byte counters aren't
+// labeled by destination: OnPacket is called for packets rejected before a
+// destination could even be parsed, so there's no destination to label a
+// rejected packet with.
+package prometheus
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/luntan365/ipproxy"
+)
+
+// Tracker is an ipproxy.ConnTracker that records Prometheus metrics. Create
+// one with New and register it with a prometheus.Registerer, then pass it as
+// Opts.ConnTracker.
+type Tracker struct {
+	packetsTotal *prometheus.CounterVec
+	bytesTotal   *prometheus.CounterVec
+	tcpOpenTotal *prometheus.CounterVec
+	udpOpenTotal *prometheus.CounterVec
+	connLifetime *prometheus.HistogramVec
+}
+
+// New creates a Tracker. namespace and subsystem are used as the Prometheus
+// metric namespace/subsystem, e.g. "ipproxy" and "".
+func New(namespace, subsystem string) *Tracker {
+	return &Tracker{
+		packetsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "packets_total",
+			Help:      "Total packets seen by the proxy, labeled by protocol and whether they were accepted.",
+		}, []string{"proto", "accepted"}),
+		bytesTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "bytes_total",
+			Help:      "Total packet bytes seen by the proxy, labeled by protocol and whether they were accepted.",
+		}, []string{"proto", "accepted"}),
+		tcpOpenTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "tcp_conns_opened_total",
+			Help:      "Total TCP connections opened to a destination.",
+		}, []string{"dest"}),
+		udpOpenTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "udp_conns_opened_total",
+			Help:      "Total UDP flows opened to a destination.",
+		}, []string{"dest"}),
+		connLifetime: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "conn_lifetime_seconds",
+			Help:      "Lifetime of proxied connections, labeled by protocol.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 4, 12),
+		}, []string{"proto"}),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (t *Tracker) Describe(ch chan<- *prometheus.Desc) {
+	t.packetsTotal.Describe(ch)
+	t.bytesTotal.Describe(ch)
+	t.tcpOpenTotal.Describe(ch)
+	t.udpOpenTotal.Describe(ch)
+	t.connLifetime.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (t *Tracker) Collect(ch chan<- prometheus.Metric) {
+	t.packetsTotal.Collect(ch)
+	t.bytesTotal.Collect(ch)
+	t.tcpOpenTotal.Collect(ch)
+	t.udpOpenTotal.Collect(ch)
+	t.connLifetime.Collect(ch)
+}
+
+func (t *Tracker) OnPacket(raw []byte, ipProto uint8, accepted bool) {
+	labels := prometheus.Labels{"proto": strconv.Itoa(int(ipProto)), "accepted": strconv.FormatBool(accepted)}
+	t.packetsTotal.With(labels).Inc()
+	t.bytesTotal.With(labels).Add(float64(len(raw)))
+}
+
+func (t *Tracker) OnTCPOpen(dest, client string) {
+	t.tcpOpenTotal.WithLabelValues(dest).Inc()
+}
+
+func (t *Tracker) OnTCPClose(dest, client string, lifetime time.Duration) {
+	t.connLifetime.WithLabelValues("tcp").Observe(lifetime.Seconds())
+}
+
+func (t *Tracker) OnUDPOpen(dest, client string) {
+	t.udpOpenTotal.WithLabelValues(dest).Inc()
+}
+
+func (t *Tracker) OnUDPClose(dest, client string, lifetime time.Duration) {
+	t.connLifetime.WithLabelValues("udp").Observe(lifetime.Seconds())
+}
+
+func (t *Tracker) OnReap(tcpReaped, udpReaped int) {}
+
+var _ ipproxy.ConnTracker = (*Tracker)(nil)
@@ -0,0 +1,108 @@
+package ipproxy
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/waiter"
+
+	"github.com/getlantern/errors"
+)
+
+// handleDNS intercepts a single TCP DNS query on dest (RFC 1035 section
+// 4.2.2 length-prefixed framing) via Opts.DNSHandler, before upstream is
+// ever dialed. It returns true if the accepted connection was fully
+// handled (a response was written, the query was malformed, or the handler
+// declined), meaning dial must not proceed to dialing upstream.
+func (dest *tcpDest) handleDNS(acceptedEp tcpip.Endpoint, wq *waiter.Queue, downstreamAddr tcpip.FullAddress) bool {
+	waitEntry, notifyCh := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&waitEntry, waiter.EventIn)
+	defer wq.EventUnregister(&waitEntry)
+
+	query, err := readFramedTCPMessage(acceptedEp, notifyCh, dest.p.opts.DNSQueryTimeout)
+	if err != nil {
+		log.Debugf("Error reading intercepted DNS query from %v: %v", fullAddrString(downstreamAddr), err)
+		acceptedEp.Close()
+		return true
+	}
+
+	response, forward := dest.p.opts.DNSHandler(query, net.IP(downstreamAddr.Addr))
+	if forward {
+		return false
+	}
+
+	if len(response) > 0 {
+		framed := make([]byte, 2+len(response))
+		binary.BigEndian.PutUint16(framed, uint16(len(response)))
+		copy(framed[2:], response)
+		if writeErr := writeToEndpoint(acceptedEp, framed, tcpip.WriteOptions{}); writeErr != nil {
+			log.Debugf("Error writing intercepted DNS response to %v: %v", fullAddrString(downstreamAddr), writeErr)
+		}
+	}
+	acceptedEp.Close()
+	return true
+}
+
+// readFramedTCPMessage reads one RFC 1035 length-prefixed DNS message from
+// ep, blocking on notifyCh between ErrWouldBlock reads until the full
+// 2-byte length prefix and message body have arrived, or returning an error
+// if timeout elapses first. Without a deadline, a client that opens the
+// connection and then never finishes sending its query would pin this
+// goroutine (and the tcpDest's halfOpen slot it's holding) forever.
+func readFramedTCPMessage(ep tcpip.Endpoint, notifyCh chan struct{}, timeout time.Duration) ([]byte, error) {
+	r := &tcpStreamReader{ep: ep, notifyCh: notifyCh, deadline: time.Now().Add(timeout)}
+	header, err := r.readFull(2)
+	if err != nil {
+		return nil, err
+	}
+	msgLen := binary.BigEndian.Uint16(header)
+	return r.readFull(int(msgLen))
+}
+
+// tcpStreamReader accumulates reads from a netstack endpoint so that a
+// single ep.Read can be split across multiple logical readFull calls. A
+// netstack Read isn't required to return exactly the number of bytes asked
+// for; it may coalesce the length prefix and the message body (or more)
+// into one segment, so any bytes beyond what a given readFull needs are
+// held in pending for the next call rather than being discarded.
+type tcpStreamReader struct {
+	ep       tcpip.Endpoint
+	notifyCh chan struct{}
+	pending  []byte
+	deadline time.Time
+}
+
+// readFull returns exactly n bytes read from r, blocking on r.notifyCh
+// between ErrWouldBlock reads as needed, up to r.deadline.
+func (r *tcpStreamReader) readFull(n int) ([]byte, error) {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		if len(r.pending) == 0 {
+			buf, _, readErr := r.ep.Read(nil)
+			if readErr != nil {
+				if readErr == tcpip.ErrWouldBlock {
+					timer := time.NewTimer(time.Until(r.deadline))
+					select {
+					case <-r.notifyCh:
+						timer.Stop()
+						continue
+					case <-timer.C:
+						return nil, errors.New("timed out waiting for DNS query")
+					}
+				}
+				return nil, errors.New("read failed: %v", readErr)
+			}
+			r.pending = buf
+		}
+
+		need := n - len(out)
+		if need > len(r.pending) {
+			need = len(r.pending)
+		}
+		out = append(out, r.pending[:need]...)
+		r.pending = r.pending[need:]
+	}
+	return out, nil
+}
@@ -0,0 +1,163 @@
+// Package dns provides an ipproxy.DNSHandler that lets plaintext DNS queries
+// intercepted off the tunnel be answered from a local hosts-file override or
+// transparently upgraded to an encrypted resolver (DNS-over-HTTPS or
+// DNS-over-TLS), without the client ever being told its resolver changed.
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+
+	"github.com/luntan365/ipproxy"
+)
+
+var log = golog.LoggerFor("ipproxy.dns")
+
+const dnsMessageMIMEType = "application/dns-message"
+
+// Resolver upgrades plaintext DNS queries intercepted from the tunnel to an
+// upstream encrypted resolver, with optional hosts-file style overrides
+// answered locally. Create one with New and pass its Handle method as
+// ipproxy.Opts.DNSHandler.
+type Resolver struct {
+	opts *Opts
+}
+
+// Opts configures a Resolver.
+type Opts struct {
+	// DoHURL or DoTAddr selects the encrypted upstream resolver to forward
+	// non-overridden queries to. Exactly one of them must be set.
+	DoHURL  string
+	DoTAddr string
+
+	// Hosts maps a hostname (as it appears in the query, case-insensitive,
+	// trailing dot optional) to the IP address that should be returned
+	// instead of forwarding upstream. Checked before the upstream resolver.
+	Hosts map[string]net.IP
+
+	// Timeout bounds how long a single upstream lookup may take. Defaults
+	// to 5 seconds.
+	Timeout time.Duration
+
+	// DialTLS dials the DoT upstream. Defaults to tls.Dialer.DialContext.
+	DialTLS func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+func (o *Opts) applyDefaults() *Opts {
+	if o.Timeout <= 0 {
+		o.Timeout = 5 * time.Second
+	}
+	if o.DialTLS == nil {
+		d := &tls.Dialer{}
+		o.DialTLS = d.DialContext
+	}
+	return o
+}
+
+// New creates a Resolver. Exactly one of opts.DoHURL/opts.DoTAddr must be
+// set.
+func New(opts *Opts) (*Resolver, error) {
+	opts = opts.applyDefaults()
+	if (opts.DoHURL == "") == (opts.DoTAddr == "") {
+		return nil, errors.New("exactly one of DoHURL or DoTAddr must be set")
+	}
+	return &Resolver{opts: opts}, nil
+}
+
+var _ ipproxy.DNSHandler = (*Resolver)(nil).Handle
+
+// Handle is an ipproxy.DNSHandler. It answers from Hosts when the query
+// name matches an override, otherwise forwards the query upstream over DoH
+// or DoT and relays the response, always reporting forward as false since
+// the query is fully handled here rather than passed on to the tunnel's
+// normal upstream dialer.
+func (r *Resolver) Handle(query []byte, srcIP net.IP) (response []byte, forward bool) {
+	if hostsResponse := r.answerFromHosts(query); hostsResponse != nil {
+		return hostsResponse, false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.opts.Timeout)
+	defer cancel()
+
+	var resp []byte
+	var err error
+	if r.opts.DoHURL != "" {
+		resp, err = r.forwardDoH(ctx, query)
+	} else {
+		resp, err = r.forwardDoT(ctx, query)
+	}
+	if err != nil {
+		log.Debugf("Error forwarding intercepted DNS query from %v: %v", srcIP, err)
+		return nil, false
+	}
+	return resp, false
+}
+
+func (r *Resolver) forwardDoH(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.opts.DoHURL, newBytesReader(query))
+	if err != nil {
+		return nil, errors.New("unable to build DoH request: %v", err)
+	}
+	req.Header.Set("Content-Type", dnsMessageMIMEType)
+	req.Header.Set("Accept", dnsMessageMIMEType)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.New("DoH request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("DoH resolver returned status %v", resp.Status)
+	}
+	return readAllLimited(resp.Body, maxDNSMessageSize)
+}
+
+func (r *Resolver) forwardDoT(ctx context.Context, query []byte) ([]byte, error) {
+	conn, err := r.opts.DialTLS(ctx, "tcp", r.opts.DoTAddr)
+	if err != nil {
+		return nil, errors.New("unable to dial DoT resolver: %v", err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	framed, err := frameTCPMessage(query)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(framed); err != nil {
+		return nil, errors.New("unable to write DoT query: %v", err)
+	}
+	return readFramedTCPMessage(conn)
+}
+
+// answerFromHosts synthesizes an A/AAAA response for a query whose question
+// name matches an entry in Hosts, or returns nil if there's no override (or
+// the query couldn't be parsed, in which case it's left to fall through to
+// the upstream resolver).
+func (r *Resolver) answerFromHosts(query []byte) []byte {
+	if len(r.opts.Hosts) == 0 {
+		return nil
+	}
+	name, qtype, ok := parseQuestion(query)
+	if !ok {
+		return nil
+	}
+	ip, ok := r.opts.Hosts[normalizeName(name)]
+	if !ok {
+		return nil
+	}
+	response, ok := buildAnswer(query, ip, qtype)
+	if !ok {
+		return nil
+	}
+	return response
+}
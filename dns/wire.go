@@ -0,0 +1,167 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+// maxDNSMessageSize is the largest message a length-prefixed DNS transport
+// (TCP or DoT) can carry, per RFC 1035 section 4.2.2.
+const maxDNSMessageSize = 65535
+
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsClassIN  = 1
+)
+
+func newBytesReader(b []byte) io.Reader {
+	return bytes.NewReader(b)
+}
+
+func readAllLimited(r io.Reader, limit int) ([]byte, error) {
+	return ioutil.ReadAll(io.LimitReader(r, int64(limit)))
+}
+
+func frameTCPMessage(msg []byte) ([]byte, error) {
+	if len(msg) > maxDNSMessageSize {
+		return nil, errors.New("dns: message too large to frame")
+	}
+	framed := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(framed, uint16(len(msg)))
+	copy(framed[2:], msg)
+	return framed, nil
+}
+
+func readFramedTCPMessage(r io.Reader) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(header))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// parseQuestion extracts the name and qtype of the first question in a DNS
+// message. It only supports the single-question messages that resolvers
+// actually send, which is all the Hosts override needs to handle.
+func parseQuestion(msg []byte) (name string, qtype uint16, ok bool) {
+	const headerLen = 12
+	if len(msg) < headerLen+1 {
+		return "", 0, false
+	}
+	qdcount := binary.BigEndian.Uint16(msg[4:6])
+	if qdcount < 1 {
+		return "", 0, false
+	}
+
+	var labels []string
+	i := headerLen
+	for {
+		if i >= len(msg) {
+			return "", 0, false
+		}
+		n := int(msg[i])
+		if n == 0 {
+			i++
+			break
+		}
+		if n&0xc0 != 0 {
+			// compression pointers don't appear in well-formed queries
+			return "", 0, false
+		}
+		i++
+		if i+n > len(msg) {
+			return "", 0, false
+		}
+		labels = append(labels, string(msg[i:i+n]))
+		i += n
+	}
+	if i+4 > len(msg) {
+		return "", 0, false
+	}
+	qtype = binary.BigEndian.Uint16(msg[i : i+2])
+	return strings.Join(labels, "."), qtype, true
+}
+
+func normalizeName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// buildAnswer synthesizes a response to query containing a single answer RR
+// for ip, reusing query's header (with the response bits set) and question
+// section. It returns ok=false if qtype doesn't match ip's address family,
+// since a Hosts override only applies to the record type it was defined for.
+func buildAnswer(query []byte, ip net.IP, qtype uint16) (response []byte, ok bool) {
+	var rdata []byte
+	switch qtype {
+	case dnsTypeA:
+		rdata = []byte(ip.To4())
+	case dnsTypeAAAA:
+		if ip.To4() == nil {
+			rdata = []byte(ip.To16())
+		}
+	}
+	if len(rdata) == 0 {
+		return nil, false
+	}
+
+	const headerLen = 12
+	questionEnd := questionSectionEnd(query)
+	if questionEnd < 0 {
+		return nil, false
+	}
+
+	resp := make([]byte, headerLen)
+	copy(resp, query[:headerLen])
+	resp[2] |= 0x80                            // QR: this is a response
+	resp[3] &^= 0x0f                           // RCODE: no error
+	binary.BigEndian.PutUint16(resp[6:8], 1)   // ANCOUNT: one answer
+	binary.BigEndian.PutUint16(resp[8:10], 0)  // NSCOUNT: none
+	binary.BigEndian.PutUint16(resp[10:12], 0) // ARCOUNT: none; we don't echo back the query's EDNS0 OPT, if any
+
+	resp = append(resp, query[headerLen:questionEnd]...)
+
+	resp = append(resp, 0xc0, 0x0c) // NAME: pointer to the question at offset 12
+	resp = append(resp, byte(qtype>>8), byte(qtype))
+	resp = append(resp, 0x00, dnsClassIN)
+	resp = append(resp, 0, 0, 0, 60) // TTL: 60s
+	resp = append(resp, byte(len(rdata)>>8), byte(len(rdata)))
+	resp = append(resp, rdata...)
+
+	return resp, true
+}
+
+// questionSectionEnd returns the byte offset just past msg's question
+// section (name, qtype, qclass), or -1 if msg is too short to contain one.
+func questionSectionEnd(msg []byte) int {
+	const headerLen = 12
+	i := headerLen
+	for {
+		if i >= len(msg) {
+			return -1
+		}
+		n := int(msg[i])
+		i++
+		if n == 0 {
+			break
+		}
+		if i+n > len(msg) {
+			return -1
+		}
+		i += n
+	}
+	i += 4 // qtype + qclass
+	if i > len(msg) {
+		return -1
+	}
+	return i
+}
@@ -0,0 +1,85 @@
+package dns
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// buildQuery constructs a minimal well-formed DNS query for name/qtype, with
+// qdcount=1 and the given arcount (to simulate e.g. an EDNS0 OPT record
+// without actually encoding one, since buildAnswer only reads the header and
+// question section).
+func buildQuery(name string, qtype uint16, arcount uint16) []byte {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[4:6], 1) // QDCOUNT
+	binary.BigEndian.PutUint16(msg[10:12], arcount)
+
+	for _, label := range splitLabels(name) {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0) // root label
+	msg = append(msg, byte(qtype>>8), byte(qtype))
+	msg = append(msg, 0x00, dnsClassIN)
+	return msg
+}
+
+func splitLabels(name string) []string {
+	var labels []string
+	start := 0
+	for i := 0; i <= len(name); i++ {
+		if i == len(name) || name[i] == '.' {
+			labels = append(labels, name[start:i])
+			start = i + 1
+		}
+	}
+	return labels
+}
+
+func TestParseQuestion(t *testing.T) {
+	query := buildQuery("example.com", dnsTypeA, 0)
+	name, qtype, ok := parseQuestion(query)
+	if !ok {
+		t.Fatal("parseQuestion returned ok=false for a well-formed query")
+	}
+	if name != "example.com" {
+		t.Errorf("name = %q, want %q", name, "example.com")
+	}
+	if qtype != dnsTypeA {
+		t.Errorf("qtype = %v, want %v", qtype, dnsTypeA)
+	}
+}
+
+func TestParseQuestionRejectsTruncatedMessage(t *testing.T) {
+	if _, _, ok := parseQuestion(make([]byte, 8)); ok {
+		t.Error("parseQuestion returned ok=true for a message shorter than a header")
+	}
+}
+
+func TestBuildAnswerZeroesNSCOUNTAndARCOUNT(t *testing.T) {
+	// A query carrying a non-zero ARCOUNT (as real resolvers do for EDNS0)
+	// must not have that count echoed into the synthesized response, since
+	// the response doesn't actually include the corresponding RR.
+	query := buildQuery("example.com", dnsTypeA, 1)
+	resp, ok := buildAnswer(query, net.ParseIP("10.0.0.1"), dnsTypeA)
+	if !ok {
+		t.Fatal("buildAnswer returned ok=false")
+	}
+	if nscount := binary.BigEndian.Uint16(resp[8:10]); nscount != 0 {
+		t.Errorf("NSCOUNT = %v, want 0", nscount)
+	}
+	if arcount := binary.BigEndian.Uint16(resp[10:12]); arcount != 0 {
+		t.Errorf("ARCOUNT = %v, want 0", arcount)
+	}
+	if ancount := binary.BigEndian.Uint16(resp[6:8]); ancount != 1 {
+		t.Errorf("ANCOUNT = %v, want 1", ancount)
+	}
+}
+
+func TestBuildAnswerRejectsMismatchedAddressFamily(t *testing.T) {
+	query := buildQuery("example.com", dnsTypeAAAA, 0)
+	if _, ok := buildAnswer(query, net.ParseIP("10.0.0.1"), dnsTypeAAAA); ok {
+		t.Error("buildAnswer returned ok=true for an IPv4 address against an AAAA question")
+	}
+}
@@ -1,11 +1,12 @@
-// Package ipproxy provides a facility for proxying IP traffic. Currently it
-// only supports TCP and UDP on top of IPv4.
+// Package ipproxy provides a facility for proxying IP traffic. It supports
+// TCP and UDP on top of IPv4 and, when enabled, IPv6.
 package ipproxy
 
 import (
 	"context"
 	"io"
 	"net"
+	"strconv"
 	"sync"
 	"time"
 
@@ -13,12 +14,16 @@ import (
 	"github.com/google/netstack/tcpip/buffer"
 	"github.com/google/netstack/tcpip/link/channel"
 	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/network/ipv6"
 	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/icmp"
 	"github.com/google/netstack/tcpip/transport/tcp"
 	"github.com/google/netstack/tcpip/transport/udp"
 
 	"github.com/getlantern/errors"
 	"github.com/getlantern/golog"
+
+	"github.com/luntan365/ipproxy/upstream"
 )
 
 var (
@@ -32,6 +37,24 @@ const (
 	DefaultTCPConnectBacklog   = 10
 	DefaultStatsInterval       = 15 * time.Second
 
+	// DefaultMaxHalfOpenPerDest caps, per destination, how many accepted TCP
+	// connections may be waiting on a dial to upstream at once.
+	DefaultMaxHalfOpenPerDest = 1000
+
+	// DefaultSynCookieThreshold is the half-open queue depth at which the
+	// TCP stack starts using SYN cookies instead of full per-connection
+	// state (RFC 4987).
+	DefaultSynCookieThreshold = 100
+
+	// DefaultDialWorkers bounds how many upstream dials a single TCP
+	// destination may have in flight at once.
+	DefaultDialWorkers = 16
+
+	// DefaultDNSQueryTimeout bounds how long an intercepted TCP/53
+	// connection may sit waiting for a client to finish sending its
+	// length-prefixed query before it's given up on and closed.
+	DefaultDNSQueryTimeout = 10 * time.Second
+
 	IPProtocolICMP = 1
 	IPProtocolTCP  = 6
 	IPProtocolUDP  = 17
@@ -64,8 +87,92 @@ type Opts struct {
 	// DialUDP specifies a function for dialing upstream UDP connections. Defaults
 	// to net.Dialer.DialContext().
 	DialUDP func(ctx context.Context, network, addr string) (*net.UDPConn, error)
+
+	// EnableIPv6 controls whether the proxy also registers the IPv6 network
+	// protocol alongside IPv4. When false (the default), inbound IPv6 packets
+	// are rejected just like any other unrecognized packet.
+	EnableIPv6 bool
+
+	// Upstream, when set, provides DialTCP/DialUDP implementations that
+	// forward traffic through one or more external SOCKS5 or HTTP CONNECT
+	// proxies (see package github.com/luntan365/ipproxy/upstream). It's only
+	// consulted in ApplyDefaults if DialTCP/DialUDP haven't already been set
+	// explicitly.
+	Upstream upstream.Dialer
+
+	// ConnTracker, if set, receives lifecycle events for packets and
+	// connections flowing through the proxy. Defaults to a no-op tracker.
+	ConnTracker ConnTracker
+
+	// PerConnBytesPerSec, if > 0, caps the sustained byte rate, in both
+	// directions together, of each Limiter key (see Classifier). With the
+	// default Classifier, all connections to the same destination share one
+	// key. Defaults to unlimited.
+	PerConnBytesPerSec int
+
+	// PerConnPacketsPerSec, if > 0, caps the sustained packet rate, in both
+	// directions together, of each Limiter key (see Classifier). With the
+	// default Classifier, all connections to the same destination share one
+	// key. Defaults to unlimited.
+	PerConnPacketsPerSec int
+
+	// GlobalBytesPerSec, if > 0, caps the sustained byte rate of all inbound
+	// traffic read from downstream. Defaults to unlimited.
+	GlobalBytesPerSec int
+
+	// Limiter, if set, overrides the token-bucket Limiter otherwise built
+	// from PerConnBytesPerSec/PerConnPacketsPerSec/GlobalBytesPerSec, e.g.
+	// to supply a hierarchical (HTB-style) limiter. Defaults to a Limiter
+	// built from those fields, or a no-op Limiter if none of them are set.
+	Limiter Limiter
+
+	// Classifier derives the Limiter key for each proxied connection from
+	// its destination (in host:port form). Defaults to one bucket per
+	// destination.
+	Classifier Classifier
+
+	// MaxHalfOpenPerDest caps, per destination, how many TCP connections
+	// may be accepted from the netstack but not yet fully established with
+	// upstream. Once reached, newly accepted connections are dropped
+	// instead of queued, bounding memory and file descriptor use under a
+	// SYN flood to a slow upstream. Defaults to DefaultMaxHalfOpenPerDest.
+	MaxHalfOpenPerDest int
+
+	// SynCookieThreshold sets how many connections may be half-open (in
+	// SYN-RCVD) on the TCP stack before it switches to SYN cookies. The
+	// count is stack-wide, across all destinations, not per destination.
+	// Defaults to DefaultSynCookieThreshold.
+	SynCookieThreshold int
+
+	// DialWorkers bounds how many upstream dials a single TCP destination
+	// may have in flight at once, so Accept() never blocks waiting on a
+	// slow or unreachable upstream. Defaults to DefaultDialWorkers.
+	DialWorkers int
+
+	// DNSHandler, if set, is consulted for every TCP destination on port 53
+	// before dialing upstream (and, in the UDP path, for every UDP/53
+	// packet) with the raw DNS query and the client's source IP. If it
+	// returns forward as false, response is written straight back to
+	// downstream and upstream is never dialed; if forward is true,
+	// response is ignored and the query proceeds to upstream as normal.
+	// Defaults to nil, meaning DNS traffic is proxied through like anything
+	// else. See package github.com/luntan365/ipproxy/dns for a ready-made
+	// handler that forwards to DoH/DoT resolvers with hosts-file overrides.
+	DNSHandler DNSHandler
+
+	// DNSQueryTimeout bounds how long an intercepted TCP/53 connection may
+	// sit waiting for a client to finish sending its length-prefixed query
+	// before it's closed, so a stalled or malicious client can't pin a
+	// goroutine and a MaxHalfOpenPerDest slot forever. Only meaningful if
+	// DNSHandler is set. Defaults to DefaultDNSQueryTimeout.
+	DNSQueryTimeout time.Duration
 }
 
+// DNSHandler intercepts a single DNS query bound for port 53, identified by
+// its raw wire-format bytes (sans any TCP length prefix) and the client's
+// source IP. See Opts.DNSHandler.
+type DNSHandler func(query []byte, srcIP net.IP) (response []byte, forward bool)
+
 // ApplyDefaults applies the default values to the given Opts, including making
 // a new Opts if opts is nil.
 func (opts *Opts) ApplyDefaults() *Opts {
@@ -87,6 +194,37 @@ func (opts *Opts) ApplyDefaults() *Opts {
 	if opts.StatsInterval <= 0 {
 		opts.StatsInterval = DefaultStatsInterval
 	}
+	if opts.ConnTracker == nil {
+		opts.ConnTracker = noopConnTracker{}
+	}
+	if opts.Classifier == nil {
+		opts.Classifier = defaultClassifier
+	}
+	if opts.MaxHalfOpenPerDest <= 0 {
+		opts.MaxHalfOpenPerDest = DefaultMaxHalfOpenPerDest
+	}
+	if opts.SynCookieThreshold <= 0 {
+		opts.SynCookieThreshold = DefaultSynCookieThreshold
+	}
+	if opts.DialWorkers <= 0 {
+		opts.DialWorkers = DefaultDialWorkers
+	}
+	if opts.DNSQueryTimeout <= 0 {
+		opts.DNSQueryTimeout = DefaultDNSQueryTimeout
+	}
+	if opts.Limiter == nil {
+		if opts.PerConnBytesPerSec > 0 || opts.PerConnPacketsPerSec > 0 || opts.GlobalBytesPerSec > 0 {
+			opts.Limiter = newTokenBucketLimiter(opts.PerConnBytesPerSec, opts.PerConnPacketsPerSec, opts.GlobalBytesPerSec)
+		} else {
+			opts.Limiter = noopLimiter{}
+		}
+	}
+	if opts.DialTCP == nil && opts.Upstream != nil {
+		opts.DialTCP = opts.Upstream.DialTCP
+	}
+	if opts.DialUDP == nil && opts.Upstream != nil {
+		opts.DialUDP = opts.Upstream.DialUDP
+	}
 	if opts.DialTCP == nil {
 		d := &net.Dialer{}
 		opts.DialTCP = d.DialContext
@@ -108,33 +246,12 @@ type Proxy interface {
 	// Serve starts proxying and blocks until finished
 	Serve() error
 
-	// Count of accepted packets
-	AcceptedPackets() int
-
-	// Count of rejected packets
-	RejectedPackets() int
-
-	// Number of TCP origins being tracked
-	NumTCPOrigins() int
-
-	// Number of TCP connections being tracked
-	NumTCPConns() int
-
-	// Number of UDP "connections" being tracked
-	NumUDPConns() int
-
 	// Close shuts down the proxy in an orderly fashion and blocks until shutdown
 	// is complete.
 	Close() error
 }
 
 type proxy struct {
-	acceptedPackets int64
-	rejectedPackets int64
-	numTcpOrigins   int64
-	numTcpConns     int64
-	numUdpConns     int64
-
 	opts       *Opts
 	proto      tcpip.NetworkProtocolNumber
 	downstream io.ReadWriter
@@ -143,8 +260,18 @@ type proxy struct {
 	tcpOrigins map[addr]*tcpOrigin
 	udpConns   map[fourtuple]*udpConn
 
+	// udpConnTrackMx guards udpConns, the same way tcpConnTrackMx guards TCP's
+	// destination tracking map.
+	udpConnTrackMx sync.Mutex
+
 	toDownstream chan channel.PacketInfo
 
+	// upstreamBufPool pools the MTU-sized buffers that baseConn.copyFromUpstream
+	// reads into, since those buffers are fully consumed (copied into the
+	// tcpip stack) by the time writeToDownstream returns and can safely be
+	// reused for the next read.
+	upstreamBufPool *sync.Pool
+
 	closeable
 }
 
@@ -174,6 +301,9 @@ func New(downstream io.ReadWriter, opts *Opts) (Proxy, error) {
 		tcpOrigins:   make(map[addr]*tcpOrigin, 0),
 		udpConns:     make(map[fourtuple]*udpConn, 0),
 		toDownstream: make(chan channel.PacketInfo),
+		upstreamBufPool: &sync.Pool{
+			New: func() interface{} { return make([]byte, opts.MTU) },
+		},
 		closeable: closeable{
 			closeCh:           make(chan struct{}),
 			readyToFinalizeCh: make(chan struct{}),
@@ -193,8 +323,10 @@ func (p *proxy) readDownstreamPackets(wg *sync.WaitGroup) (finalErr error) {
 	defer wg.Wait() // wait for copyToUpstream to finish with all of its cleanup
 
 	for {
-		// we can't reuse this byte slice across reads because each one is held in
-		// memory by the tcpip stack.
+		// Unlike the upstreamBufPool buffers in baseConn.copyFromUpstream, this
+		// one isn't pooled: pkt.raw is handed off to onTCP/onUDP/onICMP, which
+		// inject it into a tcpip stack that retains it for an unknown amount of
+		// time, so it isn't safe to reuse once this loop moves on.
 		b := make([]byte, p.opts.MTU)
 		n, err := p.downstream.Read(b)
 		if err != nil {
@@ -204,10 +336,23 @@ func (p *proxy) readDownstreamPackets(wg *sync.WaitGroup) (finalErr error) {
 			return errors.New("Unexpected error reading from downstream: %v", err)
 		}
 		raw := b[:n]
+		if !p.opts.EnableIPv6 && ipVersion(raw) == 6 {
+			log.Debugf("Dropping inbound IPv6 packet, EnableIPv6 is false")
+			p.opts.ConnTracker.OnPacket(raw, 0, false)
+			continue
+		}
 		pkt, err := parseIPPacket(raw)
 		if err != nil {
 			log.Debugf("Error on inbound packet, ignoring: %v", err)
-			p.rejectedPacket()
+			p.opts.ConnTracker.OnPacket(raw, 0, false)
+			continue
+		}
+
+		// Global QoS shaping applies to all inbound traffic regardless of
+		// destination, so it's enforced here rather than per-connection.
+		if err := p.opts.Limiter.WaitGlobalBytes(context.Background(), len(raw)); err != nil {
+			log.Debugf("Rate limiter error, dropping packet: %v", err)
+			p.opts.ConnTracker.OnPacket(raw, uint8(pkt.ipProto), false)
 			continue
 		}
 
@@ -230,16 +375,20 @@ func (p *proxy) copyToUpstream(icmpStack *stack.Stack, icmpEndpoint *channel.End
 		case pkt := <-p.pktIn:
 			switch pkt.ipProto {
 			case IPProtocolTCP:
-				p.acceptedPacket()
+				p.opts.ConnTracker.OnPacket(pkt.raw, uint8(pkt.ipProto), true)
 				p.onTCP(pkt)
 			case IPProtocolUDP:
-				p.acceptedPacket()
+				p.opts.ConnTracker.OnPacket(pkt.raw, uint8(pkt.ipProto), true)
 				p.onUDP(pkt)
 			case IPProtocolICMP:
-				p.acceptedPacket()
-				icmpEndpoint.InjectInbound(p.proto, tcpip.PacketBuffer{Data: buffer.View(pkt.raw).ToVectorisedView()})
+				// IP protocol 1 is ICMPv4 only; ICMPv6 (next-header 58) is
+				// out of scope (this proxy only proxies TCP/UDP) and falls
+				// to the default case below like any other unhandled
+				// protocol.
+				p.opts.ConnTracker.OnPacket(pkt.raw, uint8(pkt.ipProto), true)
+				icmpEndpoint.InjectInbound(ipv4.ProtocolNumber, tcpip.PacketBuffer{Data: buffer.View(pkt.raw).ToVectorisedView()})
 			default:
-				p.rejectedPacket()
+				p.opts.ConnTracker.OnPacket(pkt.raw, uint8(pkt.ipProto), false)
 				log.Debugf("Unknown IP protocol, ignoring: %v", pkt.ipProto)
 				continue
 			}
@@ -260,10 +409,24 @@ func (p *proxy) copyFromUpstream() {
 		case <-p.closedCh:
 			return
 		case pktInfo := <-p.toDownstream:
-			pkt := make([]byte, 0, p.opts.MTU)
-			pkt = append(pkt, pktInfo.Pkt.Header.View()...)
-			pkt = append(pkt, pktInfo.Pkt.Data.ToView()...)
-			_, err := p.downstream.Write(pkt)
+			header := []byte(pktInfo.Pkt.Header.View())
+			data := []byte(pktInfo.Pkt.Data.ToView())
+
+			var err error
+			if conn, ok := p.downstream.(net.Conn); ok {
+				// net.Buffers only performs an actual writev (as opposed to
+				// one Write call per buffer) when the writer is a net.Conn.
+				// Any other writer -- notably the TUN device/os.File that
+				// downstream normally is -- is packet-oriented, where one
+				// Write must be one packet; splitting it into a
+				// header-only and data-only Write would corrupt the stream.
+				_, err = net.Buffers{header, data}.WriteTo(conn)
+			} else {
+				pkt := make([]byte, 0, len(header)+len(data))
+				pkt = append(pkt, header...)
+				pkt = append(pkt, data...)
+				_, err = p.downstream.Write(pkt)
+			}
 			if err != nil {
 				log.Errorf("Unexpected error writing to downstream: %v", err)
 				return
@@ -274,9 +437,15 @@ func (p *proxy) copyFromUpstream() {
 
 func (p *proxy) stackForICMP() (*stack.Stack, *channel.Endpoint, error) {
 	channelEndpoint := channel.New(p.opts.OutboundBufferDepth, uint32(p.opts.MTU), "")
+	networkProtocols := []stack.NetworkProtocol{ipv4.NewProtocol()}
+	transportProtocols := []stack.TransportProtocol{tcp.NewProtocol(), udp.NewProtocol(), icmp.NewProtocol4()}
+	if p.opts.EnableIPv6 {
+		networkProtocols = append(networkProtocols, ipv6.NewProtocol())
+		transportProtocols = append(transportProtocols, icmp.NewProtocol6())
+	}
 	s := stack.New(stack.Options{
-		NetworkProtocols:   []stack.NetworkProtocol{ipv4.NewProtocol()},
-		TransportProtocols: []stack.TransportProtocol{tcp.NewProtocol(), udp.NewProtocol()},
+		NetworkProtocols:   networkProtocols,
+		TransportProtocols: transportProtocols,
 	})
 	if err := s.CreateNIC(nicID, channelEndpoint); err != nil {
 		s.Close()
@@ -302,3 +471,29 @@ func (p *proxy) stackForICMP() (*stack.Stack, *channel.Endpoint, error) {
 	}()
 	return s, channelEndpoint, nil
 }
+
+// ipVersion reports the IP version (4 or 6) of the given raw packet based on
+// the top nibble of its first byte, as specified in RFC 791 and RFC 8200. It
+// returns 0 if raw is empty.
+func ipVersion(raw []byte) int {
+	if len(raw) == 0 {
+		return 0
+	}
+	return int(raw[0] >> 4)
+}
+
+// fullAddrString renders a tcpip.FullAddress as a host:port string, for use
+// in logs, metrics labels, and ConnTracker events.
+func fullAddrString(a tcpip.FullAddress) string {
+	return net.JoinHostPort(net.IP(a.Addr).String(), strconv.Itoa(int(a.Port)))
+}
+
+// networkProtocolForIP returns the netstack network protocol number that
+// corresponds to the given net.IP, so that per-origin stacks and endpoints
+// can be set up for IPv4 or IPv6 destinations alike.
+func networkProtocolForIP(ip net.IP) (tcpip.Address, tcpip.NetworkProtocolNumber) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return tcpip.Address(ip4), ipv4.ProtocolNumber
+	}
+	return tcpip.Address(ip.To16()), ipv6.ProtocolNumber
+}
@@ -0,0 +1,147 @@
+package ipproxy
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// minLimiterBurst is the floor we use for byte token bucket burst sizes, so
+// that a single read/write of up to a few packets' worth of bytes never
+// trips the "burst exceeded" error a very low configured rate would
+// otherwise produce.
+const minLimiterBurst = 65536
+
+// minPacketLimiterBurst is the equivalent floor for packet token buckets.
+// It's sized in packets, not bytes, so minLimiterBurst would let tens of
+// thousands of packets through in a single burst and defeat
+// PerConnPacketsPerSec entirely; a small handful of packets is enough to
+// absorb normal bursty sends without that.
+const minPacketLimiterBurst = 100
+
+// Limiter controls how quickly bytes and packets may flow through the
+// proxy. The core calls it on the hot path for every read, so
+// implementations must be cheap except when actually throttling.
+// Implementations may enforce per-connection quotas, a global quota, or a
+// hierarchy of both (HTB-style), keyed however they like.
+type Limiter interface {
+	// WaitConnBytes blocks until n more bytes may flow on the connection
+	// identified by key, or ctx is done.
+	WaitConnBytes(ctx context.Context, key string, n int) error
+
+	// WaitConnPacket blocks until one more packet may flow on the
+	// connection identified by key, or ctx is done.
+	WaitConnPacket(ctx context.Context, key string) error
+
+	// WaitGlobalBytes blocks until n more bytes may flow across the whole
+	// proxy, or ctx is done.
+	WaitGlobalBytes(ctx context.Context, n int) error
+}
+
+// Classifier derives the Limiter key for a connection to dst (in host:port
+// form). It defaults to keying by dst, i.e. one bucket per destination.
+type Classifier func(dst string) string
+
+func defaultClassifier(dst string) string { return dst }
+
+// noopLimiter never blocks. It's the default when no rate limits are
+// configured, so enabling the Limiter plumbing costs nothing when unused.
+type noopLimiter struct{}
+
+func (noopLimiter) WaitConnBytes(ctx context.Context, key string, n int) error { return nil }
+func (noopLimiter) WaitConnPacket(ctx context.Context, key string) error       { return nil }
+func (noopLimiter) WaitGlobalBytes(ctx context.Context, n int) error           { return nil }
+
+// tokenBucketLimiter is the default Limiter, built from
+// Opts.PerConnBytesPerSec/PerConnPacketsPerSec/GlobalBytesPerSec. It keeps
+// one byte bucket and one packet bucket per connection key, refilled
+// continuously, plus a single shared global byte bucket.
+type tokenBucketLimiter struct {
+	connBytesPerSec   int
+	connPacketsPerSec int
+
+	globalBytes *rate.Limiter
+
+	mx          sync.Mutex
+	connBytes   map[string]*rate.Limiter
+	connPackets map[string]*rate.Limiter
+}
+
+func newTokenBucketLimiter(perConnBytesPerSec, perConnPacketsPerSec, globalBytesPerSec int) *tokenBucketLimiter {
+	l := &tokenBucketLimiter{
+		connBytesPerSec:   perConnBytesPerSec,
+		connPacketsPerSec: perConnPacketsPerSec,
+		connBytes:         make(map[string]*rate.Limiter),
+		connPackets:       make(map[string]*rate.Limiter),
+	}
+	if globalBytesPerSec > 0 {
+		l.globalBytes = rate.NewLimiter(rate.Limit(globalBytesPerSec), burstFor(globalBytesPerSec))
+	}
+	return l
+}
+
+func burstFor(perSec int) int {
+	if perSec > minLimiterBurst {
+		return perSec
+	}
+	return minLimiterBurst
+}
+
+func packetBurstFor(perSec int) int {
+	if perSec > minPacketLimiterBurst {
+		return perSec
+	}
+	return minPacketLimiterBurst
+}
+
+func (l *tokenBucketLimiter) connBytesLimiter(key string) *rate.Limiter {
+	if l.connBytesPerSec <= 0 {
+		return nil
+	}
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	lim := l.connBytes[key]
+	if lim == nil {
+		lim = rate.NewLimiter(rate.Limit(l.connBytesPerSec), burstFor(l.connBytesPerSec))
+		l.connBytes[key] = lim
+	}
+	return lim
+}
+
+func (l *tokenBucketLimiter) connPacketsLimiter(key string) *rate.Limiter {
+	if l.connPacketsPerSec <= 0 {
+		return nil
+	}
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	lim := l.connPackets[key]
+	if lim == nil {
+		lim = rate.NewLimiter(rate.Limit(l.connPacketsPerSec), packetBurstFor(l.connPacketsPerSec))
+		l.connPackets[key] = lim
+	}
+	return lim
+}
+
+func (l *tokenBucketLimiter) WaitConnBytes(ctx context.Context, key string, n int) error {
+	lim := l.connBytesLimiter(key)
+	if lim == nil {
+		return nil
+	}
+	return lim.WaitN(ctx, n)
+}
+
+func (l *tokenBucketLimiter) WaitConnPacket(ctx context.Context, key string) error {
+	lim := l.connPacketsLimiter(key)
+	if lim == nil {
+		return nil
+	}
+	return lim.Wait(ctx)
+}
+
+func (l *tokenBucketLimiter) WaitGlobalBytes(ctx context.Context, n int) error {
+	if l.globalBytes == nil {
+		return nil
+	}
+	return l.globalBytes.WaitN(ctx, n)
+}
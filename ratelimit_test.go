@@ -0,0 +1,35 @@
+package ipproxy
+
+import "testing"
+
+func TestBurstFor(t *testing.T) {
+	if got := burstFor(10); got != minLimiterBurst {
+		t.Errorf("burstFor(10) = %v, want floor %v", got, minLimiterBurst)
+	}
+	if got := burstFor(minLimiterBurst + 1); got != minLimiterBurst+1 {
+		t.Errorf("burstFor(%v) = %v, want %v", minLimiterBurst+1, got, minLimiterBurst+1)
+	}
+}
+
+func TestPacketBurstFor(t *testing.T) {
+	if got := packetBurstFor(10); got != minPacketLimiterBurst {
+		t.Errorf("packetBurstFor(10) = %v, want floor %v", got, minPacketLimiterBurst)
+	}
+	if got := packetBurstFor(minPacketLimiterBurst + 1); got != minPacketLimiterBurst+1 {
+		t.Errorf("packetBurstFor(%v) = %v, want %v", minPacketLimiterBurst+1, got, minPacketLimiterBurst+1)
+	}
+	// A low configured packet rate must not inherit the much larger byte
+	// burst floor, or a single connection could burst tens of thousands of
+	// packets through instantly.
+	if got := packetBurstFor(10); got >= minLimiterBurst {
+		t.Errorf("packetBurstFor(10) = %v, must be far below the byte burst floor %v", got, minLimiterBurst)
+	}
+}
+
+func TestConnPacketsLimiterUsesPacketBurst(t *testing.T) {
+	l := newTokenBucketLimiter(0, 10, 0)
+	lim := l.connPacketsLimiter("key")
+	if burst := lim.Burst(); burst != minPacketLimiterBurst {
+		t.Errorf("connPacketsLimiter burst = %v, want %v", burst, minPacketLimiterBurst)
+	}
+}
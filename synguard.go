@@ -0,0 +1,65 @@
+package ipproxy
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// synGuardCapacity bounds how many distinct source IPs a synGuard tracks at
+// once, evicting the least recently seen entry once full so a flood spread
+// across many addresses can't grow this state without bound.
+const synGuardCapacity = 4096
+
+// synGuard tracks per-source-IP inbound connection rates in a small LRU, so
+// a flood concentrated on a handful of source IPs can be recognized and
+// throttled independently of overall traffic volume.
+type synGuard struct {
+	mx      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // front = most recently seen
+}
+
+type synGuardEntry struct {
+	ip    string
+	count int64
+	since time.Time
+}
+
+func newSynGuard() *synGuard {
+	return &synGuard{
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// recordSYN registers an inbound connection attempt from ip and returns the
+// number seen from it within the current 1-second window.
+func (g *synGuard) recordSYN(ip string) int64 {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+
+	now := time.Now()
+	if el, ok := g.entries[ip]; ok {
+		e := el.Value.(*synGuardEntry)
+		if now.Sub(e.since) > time.Second {
+			e.count = 0
+			e.since = now
+		}
+		e.count++
+		g.order.MoveToFront(el)
+		return e.count
+	}
+
+	e := &synGuardEntry{ip: ip, count: 1, since: now}
+	el := g.order.PushFront(e)
+	g.entries[ip] = el
+	if g.order.Len() > synGuardCapacity {
+		oldest := g.order.Back()
+		if oldest != nil {
+			g.order.Remove(oldest)
+			delete(g.entries, oldest.Value.(*synGuardEntry).ip)
+		}
+	}
+	return 1
+}
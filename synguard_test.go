@@ -0,0 +1,38 @@
+package ipproxy
+
+import "testing"
+
+func TestSynGuardRecordSYNCountsWithinWindow(t *testing.T) {
+	g := newSynGuard()
+	for i := int64(1); i <= 3; i++ {
+		if got := g.recordSYN("1.2.3.4"); got != i {
+			t.Errorf("recordSYN call %d = %v, want %v", i, got, i)
+		}
+	}
+	if got := g.recordSYN("5.6.7.8"); got != 1 {
+		t.Errorf("recordSYN for a distinct IP = %v, want 1", got)
+	}
+}
+
+func TestSynGuardEvictsLeastRecentlySeen(t *testing.T) {
+	g := newSynGuard()
+	for i := 0; i < synGuardCapacity; i++ {
+		g.recordSYN(string(rune(i)))
+	}
+	if got := len(g.entries); got != synGuardCapacity {
+		t.Fatalf("len(entries) = %v, want %v", got, synGuardCapacity)
+	}
+
+	// One more distinct IP should evict the oldest (ip for i=0) rather than
+	// growing the LRU past its capacity.
+	g.recordSYN(string(rune(synGuardCapacity)))
+	if got := len(g.entries); got != synGuardCapacity {
+		t.Errorf("len(entries) after overflow = %v, want %v", got, synGuardCapacity)
+	}
+	if _, ok := g.entries[string(rune(0))]; ok {
+		t.Errorf("oldest entry was not evicted")
+	}
+	if got := g.recordSYN(string(rune(synGuardCapacity))); got != 2 {
+		t.Errorf("recordSYN for most recently used IP = %v, want 2 (not evicted)", got)
+	}
+}
@@ -4,12 +4,15 @@ import (
 	"context"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
 	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/network/ipv6"
 	"github.com/google/netstack/tcpip/transport/tcp"
+	"github.com/google/netstack/waiter"
 
 	"github.com/getlantern/errors"
 )
@@ -31,7 +34,11 @@ func (p *proxy) onTCP(pkt ipPacket) {
 		p.tcpConnTrackMx.Unlock()
 	}
 
-	p.channelEndpoint.Inject(ipv4.ProtocolNumber, buffer.View(pkt.raw).ToVectorisedView())
+	proto := tcpip.NetworkProtocolNumber(ipv4.ProtocolNumber)
+	if ipVersion(pkt.raw) == 6 {
+		proto = ipv6.ProtocolNumber
+	}
+	p.channelEndpoint.Inject(proto, buffer.View(pkt.raw).ToVectorisedView())
 }
 
 func (p *proxy) startTCPDest(dstAddr addr) (*tcpDest, error) {
@@ -39,22 +46,35 @@ func (p *proxy) startTCPDest(dstAddr addr) (*tcpDest, error) {
 	if err := p.stack.CreateNIC(nicID, p.linkID); err != nil {
 		return nil, errors.New("Unable to create TCP NIC: %v", err)
 	}
-	ipAddr := tcpip.Address(net.ParseIP(dstAddr.ip).To4())
-	if err := p.stack.AddAddress(nicID, p.proto, ipAddr); err != nil {
+	ipAddr, proto := networkProtocolForIP(net.ParseIP(dstAddr.ip))
+	if err := p.stack.AddAddress(nicID, proto, ipAddr); err != nil {
 		return nil, errors.New("Unable to add IP addr for TCP dest: %v", err)
 	}
 
 	dest := &tcpDest{
 		baseConn: newBaseConn(p, nil, nil),
 		addr:     dstAddr.String(),
+		proto:    proto,
+		port:     dstAddr.port,
 		conns:    make(map[tcpip.FullAddress]*baseConn),
 	}
 	dest.markActive()
+	dest.baseConn.proto = proto
+	dest.baseConn.limiterKey = p.opts.Classifier(dest.addr)
+	dest.synGuard = newSynGuard()
+	dest.dialSem = make(chan struct{}, p.opts.DialWorkers)
 
-	if err := dest.init(tcp.ProtocolNumber, tcpip.FullAddress{nicID, ipAddr, dstAddr.port}); err != nil {
+	if err := dest.init(tcp.ProtocolNumber, proto, tcpip.FullAddress{nicID, ipAddr, dstAddr.port}); err != nil {
 		return nil, errors.New("Unable to initialize TCP dest: %v", err)
 	}
 
+	// Once the half-open queue gets this deep, the stack switches to SYN
+	// cookies instead of keeping full per-connection state, so a SYN flood
+	// can't exhaust memory the way it would against a naive backlog.
+	if err := p.stack.SetTransportProtocolOption(tcp.ProtocolNumber, tcpip.TCPSynRcvdCountThresholdOption(p.opts.SynCookieThreshold)); err != nil {
+		log.Debugf("Unable to set TCP SYN cookie threshold: %v", err)
+	}
+
 	if err := dest.ep.Listen(p.opts.TCPConnectBacklog); err != nil {
 		dest.finalize()
 		return nil, errors.New("Unable to listen for TCP connections: %v", err)
@@ -67,10 +87,37 @@ func (p *proxy) startTCPDest(dstAddr addr) (*tcpDest, error) {
 type tcpDest struct {
 	baseConn
 	addr    string
+	proto   tcpip.NetworkProtocolNumber
+	port    uint16
 	conns   map[tcpip.FullAddress]*baseConn
 	connsMx sync.Mutex
+
+	// synGuard tracks per-source-IP connection rates so a flood concentrated
+	// on a few source IPs can be recognized independently of overall volume.
+	synGuard *synGuard
+
+	// dialSem bounds how many upstream dials may be in flight at once, so
+	// that Accept() below never blocks waiting on a slow or unreachable
+	// upstream.
+	dialSem chan struct{}
+
+	// halfOpen counts connections that have been accepted from the netstack
+	// but haven't yet either failed to dial or been added to conns. It's
+	// what MaxHalfOpenPerDest actually bounds: conns alone only reflects
+	// connections that finished dialing, which is exactly the state a SYN
+	// flood to a slow upstream never reaches.
+	halfOpen int64
 }
 
+// maxSynPerSourcePerSec caps how many new connections a single source IP may
+// open to one destination per second. Exceeding it drops the connection
+// regardless of MaxHalfOpenPerDest, so a flood concentrated on one source IP
+// can't exhaust a destination's whole half-open budget by itself.
+const maxSynPerSourcePerSec = 100
+
+// accept drains the netstack's accept queue as fast as possible, handing
+// each accepted connection off to dial (on dest's bounded worker pool) so
+// that a slow upstream can never back up the half-open queue.
 func (dest *tcpDest) accept() {
 	for {
 		acceptedEp, wq, err := dest.ep.Accept()
@@ -83,37 +130,70 @@ func (dest *tcpDest) accept() {
 			return
 		}
 
-		upstream, dialErr := dest.p.opts.DialTCP(context.Background(), "tcp", dest.addr)
-		if dialErr != nil {
-			log.Errorf("Unexpected error dialing upstream to %v: %v", dest.addr, err)
-			return
+		downstreamAddr, _ := acceptedEp.GetRemoteAddress()
+		sourceIP := net.IP(downstreamAddr.Addr).String()
+		synRate := dest.synGuard.recordSYN(sourceIP)
+		if synRate > maxSynPerSourcePerSec {
+			log.Debugf("Dropping new TCP conn from %v to %v, exceeded per-source SYN rate (%v/sec)", sourceIP, dest.addr, synRate)
+			acceptedEp.Close()
+			continue
+		}
+		if dest.p.opts.MaxHalfOpenPerDest > 0 && int(atomic.LoadInt64(&dest.halfOpen)) >= dest.p.opts.MaxHalfOpenPerDest {
+			log.Debugf("Dropping new TCP conn from %v to %v, half-open limit reached", sourceIP, dest.addr)
+			acceptedEp.Close()
+			continue
 		}
 
-		downstreamAddr, _ := acceptedEp.GetRemoteAddress()
-		tcpConn := newBaseConnWithQueue(dest.p, upstream, wq, func() error {
-			dest.removeConn(downstreamAddr)
-			return nil
-		})
-		tcpConn.ep = acceptedEp
-		go tcpConn.copyToUpstream(nil)
-		go tcpConn.copyFromUpstream(tcpip.WriteOptions{})
-		dest.connsMx.Lock()
-		dest.conns[downstreamAddr] = &tcpConn
-		dest.connsMx.Unlock()
+		atomic.AddInt64(&dest.halfOpen, 1)
+		go dest.dial(acceptedEp, wq, downstreamAddr)
 	}
 }
 
-func (dest *tcpDest) removeConn(addr tcpip.FullAddress) {
+// dial completes the handshake for a single accepted connection by dialing
+// upstream and wiring up the proxying goroutines. It runs on dest's bounded
+// worker pool (dialSem) so a stall dialing one destination can't starve
+// accept() from draining the netstack's queues for everyone else.
+func (dest *tcpDest) dial(acceptedEp tcpip.Endpoint, wq *waiter.Queue, downstreamAddr tcpip.FullAddress) {
+	defer atomic.AddInt64(&dest.halfOpen, -1)
+
+	if dest.port == 53 && dest.p.opts.DNSHandler != nil {
+		if dest.handleDNS(acceptedEp, wq, downstreamAddr) {
+			return
+		}
+	}
+
+	dest.dialSem <- struct{}{}
+	defer func() { <-dest.dialSem }()
+
+	upstream, dialErr := dest.p.opts.DialTCP(context.Background(), "tcp", dest.addr)
+	if dialErr != nil {
+		log.Errorf("Unexpected error dialing upstream to %v: %v", dest.addr, dialErr)
+		acceptedEp.Close()
+		return
+	}
+
+	clientAddr := fullAddrString(downstreamAddr)
+	var tcpConn baseConn
+	tcpConn = newBaseConnWithQueue(dest.p, upstream, wq, func() error {
+		dest.removeConn(downstreamAddr)
+		dest.p.opts.ConnTracker.OnTCPClose(dest.addr, clientAddr, time.Since(tcpConn.opened))
+		return nil
+	})
+	tcpConn.ep = acceptedEp
+	tcpConn.proto = dest.proto
+	tcpConn.limiterKey = dest.limiterKey
+	dest.p.opts.ConnTracker.OnTCPOpen(dest.addr, clientAddr)
+	go tcpConn.copyToUpstream(nil)
+	go tcpConn.copyFromUpstream(tcpip.WriteOptions{})
 	dest.connsMx.Lock()
-	delete(dest.conns, addr)
+	dest.conns[downstreamAddr] = &tcpConn
 	dest.connsMx.Unlock()
 }
 
-func (dest *tcpDest) numConns() int {
+func (dest *tcpDest) removeConn(addr tcpip.FullAddress) {
 	dest.connsMx.Lock()
-	numConns := len(dest.conns)
+	delete(dest.conns, addr)
 	dest.connsMx.Unlock()
-	return numConns
 }
 
 // reapUDP reaps idled TCP connections and destinations. We do this on a single
@@ -128,6 +208,7 @@ func (p *proxy) reapTCP() {
 			dests[a] = dest
 		}
 		p.tcpConnTrackMx.Unlock()
+		reaped := 0
 		for a, dest := range dests {
 			dest.connsMx.Lock()
 			conns := make([]*baseConn, 0, len(dest.conns))
@@ -139,6 +220,7 @@ func (p *proxy) reapTCP() {
 				for _, conn := range dest.conns {
 					if conn.timeSinceLastActive() > p.opts.IdleTimeout {
 						go conn.Close()
+						reaped++
 					}
 				}
 			} else if dest.timeSinceLastActive() > p.opts.IdleTimeout {
@@ -146,7 +228,11 @@ func (p *proxy) reapTCP() {
 				delete(p.tcpConnTrack, a)
 				p.tcpConnTrackMx.Unlock()
 				dest.Close()
+				reaped++
 			}
 		}
+		if reaped > 0 {
+			p.opts.ConnTracker.OnReap(reaped, 0)
+		}
 	}
 }
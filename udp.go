@@ -0,0 +1,277 @@
+package ipproxy
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/network/ipv6"
+	"github.com/google/netstack/tcpip/transport/udp"
+	"github.com/google/netstack/waiter"
+
+	"github.com/getlantern/errors"
+)
+
+// fourtuple identifies a single UDP flow by its source and destination
+// addresses. Unlike TCP, where netstack's own connection state demultiplexes
+// accepted connections for a shared destination, each (client, destination)
+// pair gets its own udpConn and its own upstream socket, since UDP has no
+// connection setup to hang that demultiplexing off of.
+type fourtuple struct {
+	src addr
+	dst addr
+}
+
+// onUDP handles a single inbound UDP packet. Port 53 is special-cased: if
+// Opts.DNSHandler is set, it's consulted before anything is relayed
+// upstream, the same way tcpDest.dial's DNS interception works for TCP/53.
+func (p *proxy) onUDP(pkt ipPacket) {
+	ft := pkt.ft()
+
+	if ft.dst.port == 53 && p.opts.DNSHandler != nil {
+		if p.handleUDPDNS(pkt, ft) {
+			return
+		}
+	}
+
+	p.udpConnTrackMx.Lock()
+	conn := p.udpConns[ft]
+	p.udpConnTrackMx.Unlock()
+	if conn == nil {
+		var err error
+		conn, err = p.startUDPConn(ft)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		p.udpConnTrackMx.Lock()
+		p.udpConns[ft] = conn
+		p.udpConnTrackMx.Unlock()
+	}
+	conn.markActive()
+
+	proto := tcpip.NetworkProtocolNumber(ipv4.ProtocolNumber)
+	if ipVersion(pkt.raw) == 6 {
+		proto = ipv6.ProtocolNumber
+	}
+	p.channelEndpoint.Inject(proto, buffer.View(pkt.raw).ToVectorisedView())
+}
+
+// handleUDPDNS intercepts a single UDP/53 packet via Opts.DNSHandler,
+// without ever standing up a udpConn or dialing upstream. It returns true if
+// the packet was fully handled (a response was written, a response couldn't
+// be built, or the handler declined), meaning onUDP must not proceed to its
+// normal relay path. A packet too short to carry a UDP payload is not
+// handled and is left to the normal relay path.
+func (p *proxy) handleUDPDNS(pkt ipPacket, ft fourtuple) bool {
+	query, ok := udpPayload(pkt.raw)
+	if !ok {
+		return false
+	}
+
+	response, forward := p.opts.DNSHandler(query, net.ParseIP(ft.src.ip))
+	if forward {
+		return false
+	}
+
+	if len(response) > 0 {
+		reply, err := buildUDPReply(pkt.raw, response)
+		if err != nil {
+			log.Debugf("Error building intercepted DNS response to %v: %v", ft.src.String(), err)
+			return true
+		}
+		if _, writeErr := p.downstream.Write(reply); writeErr != nil {
+			log.Errorf("Unexpected error writing intercepted DNS response to downstream: %v", writeErr)
+		}
+	}
+	return true
+}
+
+func (p *proxy) startUDPConn(ft fourtuple) (*udpConn, error) {
+	nicID := p.nextNICID()
+	if err := p.stack.CreateNIC(nicID, p.linkID); err != nil {
+		return nil, errors.New("Unable to create UDP NIC: %v", err)
+	}
+	ipAddr, proto := networkProtocolForIP(net.ParseIP(ft.dst.ip))
+	if err := p.stack.AddAddress(nicID, proto, ipAddr); err != nil {
+		return nil, errors.New("Unable to add IP addr for UDP conn: %v", err)
+	}
+
+	wq := &waiter.Queue{}
+	ep, epErr := p.stack.NewEndpoint(udp.ProtocolNumber, proto, wq)
+	if epErr != nil {
+		return nil, errors.New("Unable to create UDP endpoint: %v", epErr)
+	}
+	if err := ep.Bind(tcpip.FullAddress{nicID, ipAddr, ft.dst.port}); err != nil {
+		ep.Close()
+		return nil, errors.New("Unable to bind UDP endpoint: %v", err)
+	}
+	clientAddr, _ := networkProtocolForIP(net.ParseIP(ft.src.ip))
+	if err := ep.Connect(tcpip.FullAddress{0, clientAddr, ft.src.port}); err != nil {
+		ep.Close()
+		return nil, errors.New("Unable to connect UDP endpoint to client: %v", err)
+	}
+
+	upstream, dialErr := p.opts.DialUDP(context.Background(), "udp", ft.dst.String())
+	if dialErr != nil {
+		ep.Close()
+		return nil, errors.New("Unable to dial upstream UDP: %v", dialErr)
+	}
+
+	clientAddrStr := ft.src.String()
+	conn := &udpConn{four: ft}
+	conn.baseConn = *newBaseConn(p, upstream, wq, func() error {
+		p.removeUDPConn(ft)
+		p.opts.ConnTracker.OnUDPClose(ft.dst.String(), clientAddrStr, time.Since(conn.opened))
+		return nil
+	})
+	conn.ep = ep
+	conn.proto = proto
+	conn.limiterKey = p.opts.Classifier(ft.dst.String())
+	p.opts.ConnTracker.OnUDPOpen(ft.dst.String(), clientAddrStr)
+
+	go conn.copyToUpstream(nil)
+	go conn.copyFromUpstream(tcpip.WriteOptions{})
+	return conn, nil
+}
+
+type udpConn struct {
+	baseConn
+	four fourtuple
+}
+
+func (p *proxy) removeUDPConn(ft fourtuple) {
+	p.udpConnTrackMx.Lock()
+	delete(p.udpConns, ft)
+	p.udpConnTrackMx.Unlock()
+}
+
+// reapUDP closes UDP flows that have been idle for longer than
+// Opts.IdleTimeout, the UDP counterpart to reapTCP.
+func (p *proxy) reapUDP() {
+	p.udpConnTrackMx.Lock()
+	conns := make([]*udpConn, 0, len(p.udpConns))
+	for _, conn := range p.udpConns {
+		conns = append(conns, conn)
+	}
+	p.udpConnTrackMx.Unlock()
+
+	reaped := 0
+	for _, conn := range conns {
+		if conn.timeSinceLastActive() > p.opts.IdleTimeout {
+			go conn.Close()
+			reaped++
+		}
+	}
+	if reaped > 0 {
+		p.opts.ConnTracker.OnReap(0, reaped)
+	}
+}
+
+func (p *proxy) closeUDP() {
+	p.udpConnTrackMx.Lock()
+	conns := make([]*udpConn, 0, len(p.udpConns))
+	for _, conn := range p.udpConns {
+		conns = append(conns, conn)
+	}
+	p.udpConnTrackMx.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// udpHeaderBytes is the fixed size of a UDP header (RFC 768): source port,
+// destination port, length, and checksum, 2 bytes each.
+const udpHeaderBytes = 8
+
+// udpPayload extracts the UDP payload (e.g. a DNS query) from a raw IPv4 or
+// IPv6 packet, or returns ok=false if raw is too short to contain one.
+func udpPayload(raw []byte) (payload []byte, ok bool) {
+	if len(raw) < 1 {
+		return nil, false
+	}
+	var ipHeaderLen int
+	if ipVersion(raw) == 6 {
+		ipHeaderLen = ipv6HeaderBytes
+	} else {
+		ipHeaderLen = int(raw[0]&0x0f) * 4
+	}
+	if len(raw) < ipHeaderLen+udpHeaderBytes {
+		return nil, false
+	}
+	return raw[ipHeaderLen+udpHeaderBytes:], true
+}
+
+// buildUDPReply builds a complete IP+UDP datagram in reply to query (a raw
+// packet as read from downstream), carrying payload, with source and
+// destination swapped so it routes back to query's original sender.
+func buildUDPReply(query []byte, payload []byte) ([]byte, error) {
+	if ipVersion(query) == 6 {
+		return buildUDPv6Reply(query, payload)
+	}
+	return buildUDPv4Reply(query, payload)
+}
+
+func buildUDPv4Reply(query []byte, payload []byte) ([]byte, error) {
+	ipHeaderLen := int(query[0]&0x0f) * 4
+	if len(query) < ipHeaderLen+udpHeaderBytes {
+		return nil, errors.New("query too short to contain a UDP header")
+	}
+
+	totalLen := ipHeaderLen + udpHeaderBytes + len(payload)
+	reply := make([]byte, totalLen)
+	copy(reply, query[:ipHeaderLen])
+
+	ip := header.IPv4(reply)
+	ip.SetSourceAddress(header.IPv4(query).DestinationAddress())
+	ip.SetDestinationAddress(header.IPv4(query).SourceAddress())
+	ip.SetTotalLength(uint16(totalLen))
+	ip.SetChecksum(0)
+	ip.SetChecksum(^ip.CalculateChecksum())
+
+	queryUDP := header.UDP(query[ipHeaderLen:])
+	replyUDP := header.UDP(reply[ipHeaderLen:])
+	replyUDP.SetSourcePort(queryUDP.DestinationPort())
+	replyUDP.SetDestinationPort(queryUDP.SourcePort())
+	replyUDP.SetLength(uint16(udpHeaderBytes + len(payload)))
+	copy(reply[ipHeaderLen+udpHeaderBytes:], payload)
+	replyUDP.SetChecksum(0)
+	xsum := header.PseudoHeaderChecksum(udp.ProtocolNumber, ip.SourceAddress(), ip.DestinationAddress(), uint16(udpHeaderBytes+len(payload)))
+	xsum = header.Checksum(replyUDP, xsum)
+	replyUDP.SetChecksum(^xsum)
+
+	return reply, nil
+}
+
+func buildUDPv6Reply(query []byte, payload []byte) ([]byte, error) {
+	if len(query) < ipv6HeaderBytes+udpHeaderBytes {
+		return nil, errors.New("query too short to contain a UDP header")
+	}
+
+	totalLen := ipv6HeaderBytes + udpHeaderBytes + len(payload)
+	reply := make([]byte, totalLen)
+	copy(reply, query[:ipv6HeaderBytes])
+
+	ip := header.IPv6(reply)
+	ip.SetSourceAddress(header.IPv6(query).DestinationAddress())
+	ip.SetDestinationAddress(header.IPv6(query).SourceAddress())
+	ip.SetPayloadLength(uint16(udpHeaderBytes + len(payload)))
+
+	queryUDP := header.UDP(query[ipv6HeaderBytes:])
+	replyUDP := header.UDP(reply[ipv6HeaderBytes:])
+	replyUDP.SetSourcePort(queryUDP.DestinationPort())
+	replyUDP.SetDestinationPort(queryUDP.SourcePort())
+	replyUDP.SetLength(uint16(udpHeaderBytes + len(payload)))
+	copy(reply[ipv6HeaderBytes+udpHeaderBytes:], payload)
+	replyUDP.SetChecksum(0)
+	xsum := header.PseudoHeaderChecksum(udp.ProtocolNumber, ip.SourceAddress(), ip.DestinationAddress(), uint16(udpHeaderBytes+len(payload)))
+	xsum = header.Checksum(replyUDP, xsum)
+	replyUDP.SetChecksum(^xsum)
+
+	return reply, nil
+}
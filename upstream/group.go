@@ -0,0 +1,67 @@
+package upstream
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+
+	"github.com/getlantern/errors"
+)
+
+// group round-robins across a set of Proxies, failing over to the next one
+// on dial error. All Proxies in a group must successfully fail before a dial
+// is reported as failed.
+type group struct {
+	dialers []Dialer
+	next    int64
+}
+
+func newGroup(proxies []*Proxy) (*group, error) {
+	dialers := make([]Dialer, 0, len(proxies))
+	for _, p := range proxies {
+		d, err := p.dialer()
+		if err != nil {
+			return nil, err
+		}
+		dialers = append(dialers, d)
+	}
+	return &group{dialers: dialers}, nil
+}
+
+// order returns the dialers in this group starting from the next
+// round-robin position, so consecutive calls spread load across proxies
+// while still trying every one of them before giving up.
+func (g *group) order() []Dialer {
+	start := int(atomic.AddInt64(&g.next, 1)-1) % len(g.dialers)
+	ordered := make([]Dialer, len(g.dialers))
+	for i := range ordered {
+		ordered[i] = g.dialers[(start+i)%len(g.dialers)]
+	}
+	return ordered
+}
+
+func (g *group) DialTCP(ctx context.Context, network, addr string) (net.Conn, error) {
+	var lastErr error
+	for _, d := range g.order() {
+		conn, err := d.DialTCP(ctx, network, addr)
+		if err == nil {
+			return conn, nil
+		}
+		log.Debugf("Upstream dial to %v failed, failing over: %v", addr, err)
+		lastErr = err
+	}
+	return nil, errors.New("all upstreams failed to dial %v: %v", addr, lastErr)
+}
+
+func (g *group) DialUDP(ctx context.Context, network, addr string) (*net.UDPConn, error) {
+	var lastErr error
+	for _, d := range g.order() {
+		conn, err := d.DialUDP(ctx, network, addr)
+		if err == nil {
+			return conn, nil
+		}
+		log.Debugf("Upstream UDP dial to %v failed, failing over: %v", addr, err)
+		lastErr = err
+	}
+	return nil, errors.New("all upstreams failed to dial UDP %v: %v", addr, lastErr)
+}
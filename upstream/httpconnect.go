@@ -0,0 +1,85 @@
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/getlantern/errors"
+)
+
+// httpConnectDialer dials upstream TCP connections through an HTTP proxy
+// using the CONNECT method. It has no UDP equivalent.
+type httpConnectDialer struct {
+	proxy *Proxy
+	pool  *connPool
+}
+
+func newHTTPConnectDialer(p *Proxy) *httpConnectDialer {
+	return &httpConnectDialer{
+		proxy: p,
+		pool:  newConnPool(p.DialTCP, p.Addr, p.MaxIdleConns),
+	}
+}
+
+func (d *httpConnectDialer) DialTCP(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.pool.get(ctx)
+	if err != nil {
+		return nil, errors.New("Unable to dial HTTP CONNECT proxy %v: %v", d.proxy.Addr, err)
+	}
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if d.proxy.Username != "" {
+		req.Header.Set("Proxy-Authorization", "Basic "+basicAuth(d.proxy.Username, d.proxy.Password))
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, errors.New("Unable to write CONNECT request to %v: %v", d.proxy.Addr, err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, errors.New("Unable to read CONNECT response from %v: %v", d.proxy.Addr, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, errors.New("CONNECT to %v via %v failed with status %v", addr, d.proxy.Addr, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		// The proxy isn't supposed to send a response body on a successful
+		// CONNECT, but guard against a buggy one anyway.
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// DialUDP always fails: HTTP CONNECT has no UDP equivalent.
+func (d *httpConnectDialer) DialUDP(ctx context.Context, network, addr string) (*net.UDPConn, error) {
+	return nil, errors.New("HTTP CONNECT proxy %v does not support UDP", d.proxy.Addr)
+}
+
+func basicAuth(username, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+}
+
+// bufferedConn lets us hand back a net.Conn whose reads are served from a
+// bufio.Reader that may already hold bytes read past the CONNECT response.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
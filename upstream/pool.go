@@ -0,0 +1,81 @@
+package upstream
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// connPool keeps a small number of idle, already-dialed (but not yet
+// negotiated) connections to a single proxy server ready for handoff, so
+// that establishing a new CONNECT tunnel doesn't always pay for a fresh TCP
+// handshake to the proxy itself. Once a connection is negotiated and handed
+// to a caller it becomes that caller's tunnel and is never returned to the
+// pool; closing it closes it for good.
+type connPool struct {
+	dial    func(ctx context.Context, network, addr string) (net.Conn, error)
+	addr    string
+	maxIdle int
+
+	mx   sync.Mutex
+	idle []net.Conn
+}
+
+func newConnPool(dial func(ctx context.Context, network, addr string) (net.Conn, error), addr string, maxIdle int) *connPool {
+	cp := &connPool{dial: dial, addr: addr, maxIdle: maxIdle}
+	go cp.refill()
+	return cp
+}
+
+// get returns an idle connection if one is available, otherwise it dials a
+// new one. Either way, it kicks off a background refill to replace the
+// idle connection it just consumed (or top up the pool if it was already
+// empty).
+func (cp *connPool) get(ctx context.Context) (net.Conn, error) {
+	conn, ok := cp.takeIdle()
+	if ok {
+		go cp.refill()
+		return conn, nil
+	}
+	conn, err := cp.dial(ctx, "tcp", cp.addr)
+	if err != nil {
+		return nil, err
+	}
+	go cp.refill()
+	return conn, nil
+}
+
+func (cp *connPool) takeIdle() (net.Conn, bool) {
+	cp.mx.Lock()
+	defer cp.mx.Unlock()
+	if n := len(cp.idle); n > 0 {
+		conn := cp.idle[n-1]
+		cp.idle = cp.idle[:n-1]
+		return conn, true
+	}
+	return nil, false
+}
+
+// refill dials a new connection in the background to keep the idle pool
+// topped up to maxIdle, best-effort.
+func (cp *connPool) refill() {
+	cp.mx.Lock()
+	full := len(cp.idle) >= cp.maxIdle
+	cp.mx.Unlock()
+	if full {
+		return
+	}
+	conn, err := cp.dial(context.Background(), "tcp", cp.addr)
+	if err != nil {
+		log.Debugf("Unable to pre-warm connection to upstream %v: %v", cp.addr, err)
+		return
+	}
+	cp.mx.Lock()
+	if len(cp.idle) >= cp.maxIdle {
+		cp.mx.Unlock()
+		conn.Close()
+		return
+	}
+	cp.idle = append(cp.idle, conn)
+	cp.mx.Unlock()
+}
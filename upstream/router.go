@@ -0,0 +1,44 @@
+package upstream
+
+import (
+	"context"
+	"net"
+
+	"github.com/getlantern/errors"
+)
+
+type routedGroup struct {
+	rule  Rule
+	group *group
+}
+
+// router is the Dialer returned by New. It dispatches each dial to the
+// group of Proxies belonging to the first Route whose Rule matches.
+type router struct {
+	routes []routedGroup
+}
+
+func (r *router) DialTCP(ctx context.Context, network, addr string) (net.Conn, error) {
+	g, err := r.groupFor(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return g.DialTCP(ctx, network, addr)
+}
+
+func (r *router) DialUDP(ctx context.Context, network, addr string) (*net.UDPConn, error) {
+	g, err := r.groupFor(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return g.DialUDP(ctx, network, addr)
+}
+
+func (r *router) groupFor(network, addr string) (*group, error) {
+	for _, rg := range r.routes {
+		if rg.rule(network, addr) {
+			return rg.group, nil
+		}
+	}
+	return nil, errors.New("no upstream Route matches %v %v", network, addr)
+}
@@ -0,0 +1,74 @@
+package upstream
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSocks5EncodeRequestIPv4(t *testing.T) {
+	req, err := socks5EncodeRequest(socks5CmdConnect, "1.2.3.4:443")
+	if err != nil {
+		t.Fatalf("socks5EncodeRequest returned error: %v", err)
+	}
+	want := []byte{socks5Version, socks5CmdConnect, 0x00, socks5AddrIPv4, 1, 2, 3, 4, 0x01, 0xbb}
+	if string(req) != string(want) {
+		t.Errorf("req = %v, want %v", req, want)
+	}
+}
+
+func TestSocks5EncodeRequestDomain(t *testing.T) {
+	req, err := socks5EncodeRequest(socks5CmdConnect, "example.com:80")
+	if err != nil {
+		t.Fatalf("socks5EncodeRequest returned error: %v", err)
+	}
+	want := append([]byte{socks5Version, socks5CmdConnect, 0x00, socks5AddrDomain, byte(len("example.com"))}, "example.com"...)
+	want = append(want, 0x00, 0x50)
+	if string(req) != string(want) {
+		t.Errorf("req = %v, want %v", req, want)
+	}
+}
+
+func TestSocks5EncodeRequestDomainTooLong(t *testing.T) {
+	long := make([]byte, 256)
+	for i := range long {
+		long[i] = 'a'
+	}
+	if _, err := socks5EncodeRequest(socks5CmdConnect, net.JoinHostPort(string(long), "80")); err == nil {
+		t.Error("expected an error for a domain name over 255 bytes, got nil")
+	}
+}
+
+func TestSocks5ReadReplyIPv4(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		server.Write([]byte{socks5Version, 0x00, 0x00, socks5AddrIPv4, 10, 0, 0, 1, 0x01, 0xbb})
+	}()
+
+	addr, err := socks5ReadReply(client)
+	if err != nil {
+		t.Fatalf("socks5ReadReply returned error: %v", err)
+	}
+	if !addr.IP.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("IP = %v, want 10.0.0.1", addr.IP)
+	}
+	if addr.Port != 443 {
+		t.Errorf("Port = %v, want 443", addr.Port)
+	}
+}
+
+func TestSocks5ReadReplyNonZeroStatus(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		server.Write([]byte{socks5Version, 0x01, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0x00, 0x00})
+	}()
+
+	if _, err := socks5ReadReply(client); err == nil {
+		t.Error("expected an error for a non-zero SOCKS5 reply status, got nil")
+	}
+}
@@ -0,0 +1,121 @@
+// Package upstream provides DialTCP/DialUDP implementations that forward
+// proxied connections through one or more external SOCKS5 or HTTP CONNECT
+// proxies, so that callers of ipproxy.New don't have to hand-write their own
+// Opts.DialTCP/Opts.DialUDP when they just want to tunnel traffic onward.
+package upstream
+
+import (
+	"context"
+	"net"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+)
+
+var log = golog.LoggerFor("ipproxy.upstream")
+
+// Dialer dials upstream TCP and UDP connections. It has the same shape as
+// ipproxy.Opts.DialTCP/DialUDP so that a Dialer can be wired in directly via
+// Opts.Upstream.
+type Dialer interface {
+	DialTCP(ctx context.Context, network, addr string) (net.Conn, error)
+	DialUDP(ctx context.Context, network, addr string) (*net.UDPConn, error)
+}
+
+// Protocol identifies the kind of external proxy a Proxy talks to.
+type Protocol string
+
+const (
+	// SOCKS5 dials through a SOCKS5 proxy (RFC 1928), including the
+	// username/password auth method from RFC 1929 and UDP ASSOCIATE.
+	SOCKS5 Protocol = "socks5"
+
+	// HTTPConnect dials through an HTTP proxy using the CONNECT method.
+	// It only supports TCP; DialUDP always fails.
+	HTTPConnect Protocol = "http-connect"
+)
+
+// Proxy describes a single external proxy to forward connections through.
+type Proxy struct {
+	// Protocol selects SOCKS5 or HTTPConnect.
+	Protocol Protocol
+
+	// Addr is the proxy's own host:port.
+	Addr string
+
+	// Username and Password are optional proxy authentication credentials.
+	Username string
+	Password string
+
+	// DialTCP dials the proxy itself (not the final destination). Defaults
+	// to net.Dialer.DialContext.
+	DialTCP func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// MaxIdleConns caps the number of idle connections to this proxy kept
+	// open for reuse by future CONNECT tunnels. Defaults to 10.
+	MaxIdleConns int
+}
+
+func (p *Proxy) applyDefaults() *Proxy {
+	if p.DialTCP == nil {
+		d := &net.Dialer{}
+		p.DialTCP = d.DialContext
+	}
+	if p.MaxIdleConns <= 0 {
+		p.MaxIdleConns = 10
+	}
+	return p
+}
+
+func (p *Proxy) dialer() (Dialer, error) {
+	p.applyDefaults()
+	switch p.Protocol {
+	case SOCKS5:
+		return newSOCKS5Dialer(p), nil
+	case HTTPConnect:
+		return newHTTPConnectDialer(p), nil
+	default:
+		return nil, errors.New("unknown upstream protocol: %v", p.Protocol)
+	}
+}
+
+// Rule decides whether a Route applies to a destination. network is "tcp" or
+// "udp", addr is the destination in host:port form.
+type Rule func(network, addr string) bool
+
+// Always is a Rule that matches every destination. It's typically used as
+// the last Route in a Router to provide a catch-all default.
+func Always(network, addr string) bool { return true }
+
+// Route pairs a Rule with the Proxies that should carry matching
+// destinations. Proxies are tried in order, failing over to the next on
+// dial error, with the starting point rotated round-robin across calls.
+type Route struct {
+	Rule    Rule
+	Proxies []*Proxy
+}
+
+// New builds a Dialer that routes each destination through the first
+// matching Route's Proxies, in round-robin order with failover. Routes are
+// evaluated in order, so a catch-all Route (see Always) should come last.
+func New(routes []Route) (Dialer, error) {
+	if len(routes) == 0 {
+		return nil, errors.New("upstream.New requires at least one Route")
+	}
+	router := &router{}
+	for _, route := range routes {
+		if len(route.Proxies) == 0 {
+			return nil, errors.New("Route has no Proxies")
+		}
+		group, err := newGroup(route.Proxies)
+		if err != nil {
+			return nil, err
+		}
+		rule := route.Rule
+		if rule == nil {
+			rule = Always
+		}
+		router.routes = append(router.routes, routedGroup{rule: rule, group: group})
+	}
+	return router, nil
+}